@@ -2,17 +2,27 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math/rand"
 	"mime/multipart"
 	"net/http"
 	"net/http/cookiejar"
+	"net/http/httputil"
+	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/demisto/download/domain"
 )
@@ -37,6 +47,127 @@ type Client struct {
 	password    string
 	server      string
 	token       string
+
+	// RetryPolicy governs whether and how a failed request is retried. Defaults to
+	// DefaultRetryPolicy() when nil.
+	RetryPolicy *RetryPolicy
+	// Middlewares are applied, in order, to every outgoing *http.Request before it is sent,
+	// letting callers add headers, sign requests, or log without modifying the Client itself.
+	Middlewares []RequestMiddleware
+
+	// Debug, when true, dumps every HTTP request and response to the logger set via SetLogger
+	// (os.Stderr by default). Multipart bodies and sensitive values are never dumped - see
+	// dumpRequest.
+	Debug  bool
+	logger io.Writer
+	last   *lastRequest
+}
+
+// SetLogger directs the output of Debug dumps to w instead of the default os.Stderr.
+func (c *Client) SetLogger(w io.Writer) {
+	c.logger = w
+}
+
+// lastRequest remembers enough about the most recently issued request to render it as curl.
+type lastRequest struct {
+	method      string
+	url         string
+	header      http.Header
+	contentType string
+	body        []byte
+}
+
+// RequestMiddleware can inspect or modify an outgoing request before it is sent. Returning an
+// error aborts the call without sending the request.
+type RequestMiddleware func(req *http.Request) error
+
+// RetryPolicy configures the built-in retry/backoff behavior of Client.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of times a request is tried, including the first attempt.
+	// A value <= 1 disables retries.
+	MaxAttempts int
+	// BaseDelay is the backoff before the second attempt; it doubles on each subsequent retry.
+	BaseDelay time.Duration
+	// MaxDelay caps the computed backoff, Retry-After included.
+	MaxDelay time.Duration
+	// ShouldRetry decides whether a failed attempt (resp is nil on a transport error) should be
+	// retried. Defaults to retrying GET requests on connection errors and 429/5xx responses;
+	// non-idempotent methods (POST, used for login and the token/user mutations) are not retried
+	// by default since a 5xx or connection error doesn't tell us whether the server already
+	// applied the request.
+	ShouldRetry func(method string, resp *http.Response, err error) bool
+}
+
+// DefaultRetryPolicy retries GET requests on connection errors and 429/5xx responses up to 3
+// times, backing off exponentially with jitter starting at 500ms and capped at 10s. POST and
+// other non-idempotent requests are never retried automatically - set a custom ShouldRetry if a
+// particular mutation is known to be safe to repeat.
+func DefaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   500 * time.Millisecond,
+		MaxDelay:    10 * time.Second,
+		ShouldRetry: func(method string, resp *http.Response, err error) bool {
+			if method != http.MethodGet {
+				return false
+			}
+			if err != nil {
+				return true
+			}
+			return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		},
+	}
+}
+
+// shouldRetry applies ShouldRetry, falling back to the default policy's rule when a caller sets
+// a custom RetryPolicy without one.
+func (p *RetryPolicy) shouldRetry(method string, resp *http.Response, err error) bool {
+	if p.ShouldRetry != nil {
+		return p.ShouldRetry(method, resp, err)
+	}
+	return DefaultRetryPolicy().ShouldRetry(method, resp, err)
+}
+
+// backoff returns how long to wait before the given retry attempt (1-based), honoring a
+// Retry-After header on resp when present, plus up to 20% jitter, capped at MaxDelay.
+func (p *RetryPolicy) backoff(attempt int, resp *http.Response) time.Duration {
+	delay := p.BaseDelay << uint(attempt-1)
+	if resp != nil {
+		if ra := resp.Header.Get("Retry-After"); ra != "" {
+			if secs, err := strconv.Atoi(ra); err == nil {
+				delay = time.Duration(secs) * time.Second
+			}
+		}
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if delay <= 0 {
+		// BaseDelay<<(attempt-1) can overflow to a negative Duration for a custom policy with a
+		// large BaseDelay and no MaxDelay to cap it - fall back to something sane rather than
+		// passing a non-positive bound to rand.Int63n below, which would panic.
+		delay = p.BaseDelay
+		if delay <= 0 {
+			delay = p.MaxDelay
+		}
+		if delay <= 0 {
+			delay = time.Second
+		}
+	}
+	delay += time.Duration(rand.Int63n(int64(delay)/5 + 1))
+	return delay
+}
+
+// APIError wraps a non-2xx response so callers can switch on the status code or inspect the
+// response body and the request path that produced it.
+type APIError struct {
+	StatusCode int
+	Path       string
+	Body       []byte
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("unexpected status code: %d (%s) for %s", e.StatusCode, http.StatusText(e.StatusCode), e.Path)
 }
 
 // New client that does not do anything yet before the login
@@ -70,78 +201,158 @@ func New(username, password, server string, insecure bool) (*Client, error) {
 	return c, nil
 }
 
-// handleError will handle responses with status code different from success
-func (c *Client) handleError(resp *http.Response) error {
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return fmt.Errorf("Unexpected status code: %d (%s)", resp.StatusCode, http.StatusText(resp.StatusCode))
+// handleError turns a non-2xx response into an *APIError, consuming its body in the process.
+// It returns a nil *APIError (not just a nil error) on success, so callers comparing against
+// nil directly still work.
+func (c *Client) handleError(path string, resp *http.Response) *APIError {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
 	}
-	return nil
+	b, _ := ioutil.ReadAll(resp.Body)
+	return &APIError{StatusCode: resp.StatusCode, Path: path, Body: b}
 }
 
 func (c *Client) req(method, path, contentType string, body io.Reader, result interface{}) error {
-	req, err := http.NewRequest(method, c.server+path, body)
-	if err != nil {
-		return err
-	}
-	req.Header.Add("Accept", "application/json")
-	if contentType == "" {
-		req.Header.Add("Content-type", "application/json")
-	} else {
-		req.Header.Add("Content-type", contentType)
+	return c.reqCtx(context.Background(), method, path, contentType, body, result)
+}
+
+// reqCtx is the context-aware counterpart of req - all request builders should funnel through
+// here so that callers can set deadlines, cancel long-running calls, propagate tracing context,
+// and benefit from the configured RetryPolicy and Middlewares.
+func (c *Client) reqCtx(ctx context.Context, method, path, contentType string, body io.Reader, result interface{}) error {
+	var bodyBytes []byte
+	if body != nil {
+		var err error
+		bodyBytes, err = ioutil.ReadAll(body)
+		if err != nil {
+			return err
+		}
 	}
-	req.Header.Add(xsrfTokenKey, c.token)
-	resp, err := c.Do(req)
-	if err != nil {
-		return err
+	policy := c.RetryPolicy
+	if policy == nil {
+		policy = DefaultRetryPolicy()
 	}
-	defer resp.Body.Close()
-	if err = c.handleError(resp); err != nil {
-		return err
+	maxAttempts := policy.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
 	}
-	if result != nil {
-		switch result := result.(type) {
-		// Should we just dump the response body
-		case io.Writer:
-			if _, err = io.Copy(result, resp.Body); err != nil {
+
+	var lastErr error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		var reqBody io.Reader
+		if bodyBytes != nil {
+			reqBody = bytes.NewReader(bodyBytes)
+		}
+		req, err := http.NewRequestWithContext(ctx, method, c.server+path, reqBody)
+		if err != nil {
+			return err
+		}
+		req.Header.Add("Accept", "application/json")
+		effectiveContentType := contentType
+		if effectiveContentType == "" {
+			effectiveContentType = "application/json"
+		}
+		req.Header.Add("Content-type", effectiveContentType)
+		req.Header.Add(xsrfTokenKey, c.token)
+		for _, mw := range c.Middlewares {
+			if err = mw(req); err != nil {
+				return err
+			}
+		}
+		c.trackRequest(req, method, c.server+path, effectiveContentType, bodyBytes)
+		resp, err := c.Do(req)
+		switch {
+		case err != nil:
+			lastErr = err
+			if attempt == maxAttempts || !policy.shouldRetry(method, nil, err) {
 				return err
 			}
 		default:
-			if err = json.NewDecoder(resp.Body).Decode(result); err != nil {
+			if c.Debug {
+				c.dumpResponse(resp)
+			}
+			if apiErr := c.handleError(path, resp); apiErr != nil {
+				resp.Body.Close()
+				lastErr = apiErr
+				if attempt == maxAttempts || !policy.shouldRetry(method, resp, nil) {
+					return apiErr
+				}
+			} else {
+				if result != nil {
+					switch result := result.(type) {
+					// Should we just dump the response body
+					case io.Writer:
+						_, err = io.Copy(result, resp.Body)
+					default:
+						err = json.NewDecoder(resp.Body).Decode(result)
+					}
+				}
+				resp.Body.Close()
 				return err
 			}
 		}
+		select {
+		case <-time.After(policy.backoff(attempt, resp)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
-	return nil
+	return lastErr
 }
 
 // Login to the Demisto download server, and returns statues code
 func (c *Client) Login() (*domain.User, error) {
+	return c.LoginContext(context.Background())
+}
+
+// LoginContext is like Login but observes ctx cancellation and deadlines
+func (c *Client) LoginContext(ctx context.Context) (*domain.User, error) {
 	creds, err := json.Marshal(c.credentials)
 	if err != nil {
 		return nil, err
 	}
 	u := &domain.User{}
-	err = c.req("POST", "login", "", bytes.NewBuffer(creds), u)
+	err = c.reqCtx(ctx, "POST", "login", "", bytes.NewBuffer(creds), u)
 	return u, err
 }
 
 // Logout from the Demisto server
 func (c *Client) Logout() error {
-	return c.req("POST", "logout", "", nil, nil)
+	return c.LogoutContext(context.Background())
+}
+
+// LogoutContext is like Logout but observes ctx cancellation and deadlines
+func (c *Client) LogoutContext(ctx context.Context) error {
+	return c.reqCtx(ctx, "POST", "logout", "", nil, nil)
 }
 
 func (c *Client) Tokens() (tokens []domain.Token, err error) {
-	err = c.req("GET", "token", "", nil, &tokens)
+	return c.TokensContext(context.Background())
+}
+
+// TokensContext is like Tokens but observes ctx cancellation and deadlines
+func (c *Client) TokensContext(ctx context.Context) (tokens []domain.Token, err error) {
+	err = c.reqCtx(ctx, "GET", "token", "", nil, &tokens)
 	return
 }
 
 func (c *Client) DownloadLog() (l []domain.DownloadLog, err error) {
-	err = c.req("GET", "log", "", nil, &l)
+	return c.DownloadLogContext(context.Background())
+}
+
+// DownloadLogContext is like DownloadLog but observes ctx cancellation and deadlines
+func (c *Client) DownloadLogContext(ctx context.Context) (l []domain.DownloadLog, err error) {
+	err = c.reqCtx(ctx, "GET", "log", "", nil, &l)
 	return
 }
 
 func (c *Client) ListDownloads() (d []domain.Download, err error) {
-	err = c.req("GET", "list-downloads", "", nil, &d)
+	return c.ListDownloadsContext(context.Background())
+}
+
+// ListDownloadsContext is like ListDownloads but observes ctx cancellation and deadlines
+func (c *Client) ListDownloadsContext(ctx context.Context) (d []domain.Download, err error) {
+	err = c.reqCtx(ctx, "GET", "list-downloads", "", nil, &d)
 	return
 }
 
@@ -155,43 +366,229 @@ type userDetails struct {
 }
 
 func (c *Client) SetUser(u *userDetails) (*domain.User, error) {
+	return c.SetUserContext(context.Background(), u)
+}
+
+// SetUserContext is like SetUser but observes ctx cancellation and deadlines
+func (c *Client) SetUserContext(ctx context.Context, u *userDetails) (*domain.User, error) {
 	b, err := json.Marshal(u)
 	if err != nil {
 		return nil, err
 	}
 	res := &domain.User{}
-	err = c.req("POST", "user", "", bytes.NewBuffer(b), res)
+	err = c.reqCtx(ctx, "POST", "user", "", bytes.NewBuffer(b), res)
 	return res, err
 }
 
+// ProgressFunc is invoked as bytes are streamed to or from the server, letting callers drive a
+// progress bar. total is the number of bytes expected for the whole transfer, or 0 if unknown.
+type ProgressFunc func(sent, total int64)
+
+// UploadOptions controls the optional streaming, resume and retry behavior of Client.Upload.
+type UploadOptions struct {
+	// Progress, when set, is called every time a chunk of the file is written to the request body.
+	Progress ProgressFunc
+	// Resume lets an upload continue from the offset the server reports via a 308 (Resume
+	// Incomplete) or 416 (Range Not Satisfiable) response instead of restarting from scratch. A
+	// resumed chunk is sent as a raw-body PUT rather than a fresh multipart envelope, so
+	// Content-Range describes exactly the bytes in the request body; the server must support
+	// that PUT-to-resume endpoint for Resume to work.
+	Resume bool
+	// MaxRetries is the number of additional attempts made after a transient error (connection
+	// failure or 5xx). Zero disables retries.
+	MaxRetries int
+}
+
+// progressReader wraps an io.Reader, reporting the cumulative number of bytes read through fn.
+type progressReader struct {
+	r     io.Reader
+	fn    ProgressFunc
+	total int64
+	sent  int64
+}
+
+func (p *progressReader) Read(buf []byte) (int, error) {
+	n, err := p.r.Read(buf)
+	if n > 0 {
+		p.sent += int64(n)
+		if p.fn != nil {
+			p.fn(p.sent, p.total)
+		}
+	}
+	return n, err
+}
+
 // Upload adds a version to the download server
 func (c *Client) Upload(name, filePath string) error {
-	b := &bytes.Buffer{}
-	writer := multipart.NewWriter(b)
-	part, err := writer.CreateFormFile("file", filepath.Base(filePath))
-	if err != nil {
-		return err
+	return c.UploadContext(context.Background(), name, filePath)
+}
+
+// UploadContext is like Upload but observes ctx cancellation and deadlines - in particular,
+// cancelling ctx aborts the file read and the in-flight POST rather than waiting for it to finish.
+func (c *Client) UploadContext(ctx context.Context, name, filePath string) error {
+	return c.UploadWithOptions(ctx, name, filePath, nil)
+}
+
+// UploadWithOptions is like UploadContext but streams the file straight into the request body
+// instead of buffering it in memory first, and honors opts for progress reporting, resuming a
+// partial upload and retrying transient failures with exponential backoff.
+func (c *Client) UploadWithOptions(ctx context.Context, name, filePath string, opts *UploadOptions) error {
+	if opts == nil {
+		opts = &UploadOptions{}
 	}
 	f, err := os.Open(filePath)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-	_, err = io.Copy(part, f)
+	info, err := f.Stat()
 	if err != nil {
 		return err
 	}
-	namePart, err := writer.CreateFormField("name")
+	total := info.Size()
+
+	var offset int64
+	var lastErr error
+	for attempt := 0; attempt <= opts.MaxRetries; attempt++ {
+		if attempt > 0 {
+			backoff := time.Duration(1<<uint(attempt-1)) * time.Second
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		retryable, newOffset, err := c.uploadOnce(ctx, name, filePath, f, offset, total, opts)
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+		if !retryable {
+			return err
+		}
+		if opts.Resume {
+			offset = newOffset
+		}
+	}
+	return lastErr
+}
+
+// uploadOnce performs a single upload attempt starting at offset: the first attempt (offset 0)
+// POSTs the whole file as multipart/form-data, while a resumed attempt (offset > 0) PUTs just
+// the remaining bytes as a raw body. It reports whether the caller should retry and, for a
+// resumable upload, the offset the server says it already has.
+func (c *Client) uploadOnce(ctx context.Context, name, filePath string, f *os.File, offset, total int64, opts *UploadOptions) (retryable bool, newOffset int64, err error) {
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		return false, offset, err
+	}
+	var req *http.Request
+	var contentType string
+	if offset == 0 {
+		req, contentType, err = c.newUploadRequest(ctx, name, filePath, f, total, opts)
+	} else {
+		req, contentType, err = c.newResumeRequest(ctx, name, f, offset, total, opts)
+	}
 	if err != nil {
-		return err
+		return false, offset, err
 	}
-	_, err = namePart.Write([]byte(name))
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add(xsrfTokenKey, c.token)
+	// The body streams from disk rather than being buffered, so there's nothing to pass here -
+	// dumpRequest already suppresses multipart bodies, and a resumed chunk's raw bytes aren't
+	// worth logging either.
+	c.trackRequest(req, req.Method, req.URL.String(), contentType, nil)
+	resp, err := c.Do(req)
 	if err != nil {
-		return err
+		return true, offset, err
 	}
-	writer.Close()
-	err = c.req("POST", "upload", writer.FormDataContentType(), b, nil)
-	return err
+	defer resp.Body.Close()
+	if c.Debug {
+		c.dumpResponse(resp)
+	}
+	switch {
+	case resp.StatusCode == http.StatusPermanentRedirect || resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		return true, resumeOffset(resp, offset), fmt.Errorf("upload incomplete: status %d (%s)", resp.StatusCode, http.StatusText(resp.StatusCode))
+	case resp.StatusCode >= 500:
+		return true, offset, fmt.Errorf("server error: %d (%s)", resp.StatusCode, http.StatusText(resp.StatusCode))
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		return false, offset, c.handleError("upload", resp)
+	}
+	return false, offset, nil
+}
+
+// newUploadRequest builds the initial upload request: a multipart/form-data POST carrying the
+// whole file plus its name, driving a multipart.Writer from a goroutine through an io.Pipe so
+// the body is streamed from disk rather than buffered whole.
+func (c *Client) newUploadRequest(ctx context.Context, name, filePath string, f *os.File, total int64, opts *UploadOptions) (*http.Request, string, error) {
+	pr, pw := io.Pipe()
+	writer := multipart.NewWriter(pw)
+	go func() {
+		part, ferr := writer.CreateFormFile("file", filepath.Base(filePath))
+		if ferr != nil {
+			pw.CloseWithError(ferr)
+			return
+		}
+		pc := &progressReader{r: f, fn: opts.Progress, total: total}
+		if _, ferr = io.Copy(part, pc); ferr != nil {
+			pw.CloseWithError(ferr)
+			return
+		}
+		namePart, ferr := writer.CreateFormField("name")
+		if ferr != nil {
+			pw.CloseWithError(ferr)
+			return
+		}
+		if _, ferr = namePart.Write([]byte(name)); ferr != nil {
+			pw.CloseWithError(ferr)
+			return
+		}
+		pw.CloseWithError(writer.Close())
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.server+"upload", pr)
+	if err != nil {
+		return nil, "", err
+	}
+	contentType := writer.FormDataContentType()
+	req.Header.Add("Content-type", contentType)
+	return req, contentType, nil
+}
+
+// newResumeRequest builds a request for a resumed upload chunk. Unlike the initial POST, this
+// sends the remaining file bytes [offset:total) as a raw body instead of re-wrapping them in a
+// new multipart envelope - a fresh multipart boundary carries no meaning at a mid-file byte
+// offset, so the server can't coherently splice it in. Sending a plain PUT whose body is exactly
+// the bytes described by Content-Range keeps the two consistent.
+func (c *Client) newResumeRequest(ctx context.Context, name string, f *os.File, offset, total int64, opts *UploadOptions) (*http.Request, string, error) {
+	pc := &progressReader{r: f, fn: opts.Progress, total: total, sent: offset}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.server+"upload?name="+url.QueryEscape(name), pc)
+	if err != nil {
+		return nil, "", err
+	}
+	contentType := "application/octet-stream"
+	req.Header.Add("Content-type", contentType)
+	req.Header.Add("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, total-1, total))
+	req.ContentLength = total - offset
+	return req, contentType, nil
+}
+
+// resumeOffset extracts the number of bytes the server already has from a 308/416 response's
+// Range header (e.g. "bytes=0-1023"), falling back to the offset already attempted.
+func resumeOffset(resp *http.Response, fallback int64) int64 {
+	rng := resp.Header.Get("Range")
+	if rng == "" {
+		return fallback
+	}
+	rng = strings.TrimPrefix(rng, "bytes=")
+	parts := strings.SplitN(rng, "-", 2)
+	if len(parts) != 2 {
+		return fallback
+	}
+	end, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return fallback
+	}
+	return end + 1
 }
 
 type newTokens struct {
@@ -200,12 +597,17 @@ type newTokens struct {
 }
 
 func (c *Client) Generate(count, downloads int) (tokens []domain.Token, err error) {
+	return c.GenerateContext(context.Background(), count, downloads)
+}
+
+// GenerateContext is like Generate but observes ctx cancellation and deadlines
+func (c *Client) GenerateContext(ctx context.Context, count, downloads int) (tokens []domain.Token, err error) {
 	nt := &newTokens{Count: count, Downloads: downloads}
 	b, err := json.Marshal(nt)
 	if err != nil {
 		return nil, err
 	}
-	err = c.req("POST", "tokens/generate", "", bytes.NewBuffer(b), &tokens)
+	err = c.reqCtx(ctx, "POST", "tokens/generate", "", bytes.NewBuffer(b), &tokens)
 	return
 }
 
@@ -215,17 +617,421 @@ type newEmailToken struct {
 }
 
 func (c *Client) GenerateForEmail(email string, downloads int) (token *domain.Token, err error) {
+	return c.GenerateForEmailContext(context.Background(), email, downloads)
+}
+
+// GenerateForEmailContext is like GenerateForEmail but observes ctx cancellation and deadlines
+func (c *Client) GenerateForEmailContext(ctx context.Context, email string, downloads int) (token *domain.Token, err error) {
 	nt := &newEmailToken{Email: email, Downloads: downloads}
 	b, err := json.Marshal(nt)
 	if err != nil {
 		return nil, err
 	}
 	token = &domain.Token{}
-	err = c.req("POST", "tokens/email", "", bytes.NewBuffer(b), &token)
+	err = c.reqCtx(ctx, "POST", "tokens/email", "", bytes.NewBuffer(b), &token)
 	return
 }
 
 func (c *Client) Questions() (questions []domain.Quiz, err error) {
-	err = c.req("GET", "quizall", "", nil, &questions)
+	return c.QuestionsContext(context.Background())
+}
+
+// QuestionsContext is like Questions but observes ctx cancellation and deadlines
+func (c *Client) QuestionsContext(ctx context.Context) (questions []domain.Quiz, err error) {
+	err = c.reqCtx(ctx, "GET", "quizall", "", nil, &questions)
 	return
 }
+
+// DownloadOptions controls the optional progress reporting of Client.Download / DownloadToFile.
+type DownloadOptions struct {
+	// Progress, when set, is called every time a chunk of the artifact is written.
+	Progress ProgressFunc
+}
+
+// DownloadError is returned when the server rejects a download token, and distinguishes why.
+type DownloadError struct {
+	*APIError
+}
+
+// Expired reports whether the token was valid but is past its expiry.
+func (e *DownloadError) Expired() bool {
+	return e.StatusCode == http.StatusGone
+}
+
+// Exhausted reports whether the token has already been used its allotted number of times.
+func (e *DownloadError) Exhausted() bool {
+	return e.StatusCode == http.StatusForbidden
+}
+
+// progressWriter wraps an io.Writer, reporting the cumulative number of bytes written through fn.
+type progressWriter struct {
+	w     io.Writer
+	fn    ProgressFunc
+	total int64
+	sent  int64
+}
+
+func (p *progressWriter) Write(buf []byte) (int, error) {
+	n, err := p.w.Write(buf)
+	if n > 0 {
+		p.sent += int64(n)
+		if p.fn != nil {
+			p.fn(p.sent, p.total)
+		}
+	}
+	return n, err
+}
+
+// Download fetches the release artifact identified by token/version, streaming it to dst and
+// verifying its SHA256 against the server's X-Checksum-Sha256 response header, if present.
+func (c *Client) Download(token, version string, dst io.Writer) error {
+	return c.DownloadContext(context.Background(), token, version, dst, nil)
+}
+
+// DownloadContext is like Download but observes ctx cancellation and deadlines, and accepts opts
+// for progress reporting.
+func (c *Client) DownloadContext(ctx context.Context, token, version string, dst io.Writer, opts *DownloadOptions) error {
+	if opts == nil {
+		opts = &DownloadOptions{}
+	}
+	path := fmt.Sprintf("download/%s/%s", token, version)
+	req, err := http.NewRequestWithContext(ctx, "GET", c.server+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Add(xsrfTokenKey, c.token)
+	c.trackRequest(req, "GET", c.server+path, "", nil)
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if c.Debug {
+		c.dumpResponse(resp)
+	}
+	if apiErr := c.handleError(path, resp); apiErr != nil {
+		return asDownloadError(apiErr)
+	}
+	hasher := sha256.New()
+	var w io.Writer = io.MultiWriter(dst, hasher)
+	if opts.Progress != nil {
+		w = &progressWriter{w: w, fn: opts.Progress, total: resp.ContentLength}
+	}
+	if _, err = io.Copy(w, resp.Body); err != nil {
+		return err
+	}
+	return compareChecksum(resp.Header.Get("X-Checksum-Sha256"), hex.EncodeToString(hasher.Sum(nil)))
+}
+
+// DownloadToFile is like Download but writes directly to path, resuming a previously interrupted
+// download from the bytes already on disk via an HTTP Range request.
+func (c *Client) DownloadToFile(token, version, path string) error {
+	return c.DownloadToFileContext(context.Background(), token, version, path, nil)
+}
+
+// DownloadToFileContext is like DownloadToFile but observes ctx cancellation and deadlines, and
+// accepts opts for progress reporting.
+func (c *Client) DownloadToFileContext(ctx context.Context, token, version, path string, opts *DownloadOptions) error {
+	if opts == nil {
+		opts = &DownloadOptions{}
+	}
+	var offset int64
+	if info, err := os.Stat(path); err == nil {
+		offset = info.Size()
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reqPath := fmt.Sprintf("download/%s/%s", token, version)
+	resp, err := c.doDownloadRequest(ctx, reqPath, offset)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if apiErr := c.handleError(reqPath, resp); apiErr != nil {
+		return asDownloadError(apiErr)
+	}
+	if offset > 0 && resp.StatusCode == http.StatusPartialContent && !resumeRangeMatches(resp, offset) {
+		// the server answered with a different range than we asked for - these bytes don't
+		// line up with what's already on disk, so discard them and re-request from scratch
+		// rather than splicing mismatched data into the file
+		resp.Body.Close()
+		if err = resetFile(f); err != nil {
+			return err
+		}
+		offset = 0
+		if resp, err = c.doDownloadRequest(ctx, reqPath, offset); err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if apiErr := c.handleError(reqPath, resp); apiErr != nil {
+			return asDownloadError(apiErr)
+		}
+	} else if offset > 0 && resp.StatusCode != http.StatusPartialContent {
+		// the server ignored our Range request, so it already sent the whole artifact
+		if err = resetFile(f); err != nil {
+			return err
+		}
+		offset = 0
+	}
+	var w io.Writer = f
+	if opts.Progress != nil {
+		w = &progressWriter{w: f, fn: opts.Progress, total: offset + resp.ContentLength, sent: offset}
+	}
+	if _, err = io.Copy(w, resp.Body); err != nil {
+		return err
+	}
+	expected := resp.Header.Get("X-Checksum-Sha256")
+	if expected == "" {
+		return nil
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	actual, err := hashFile(path)
+	if err != nil {
+		return err
+	}
+	if err = compareChecksum(expected, actual); err != nil {
+		// don't leave a corrupt file behind - a later call would see it as already complete,
+		// send no Range request (or one the server answers with 416) and never recover
+		if rmErr := os.Remove(path); rmErr != nil && !os.IsNotExist(rmErr) {
+			return rmErr
+		}
+		return err
+	}
+	return nil
+}
+
+// doDownloadRequest issues the GET for a download, adding a Range header when offset > 0, and
+// tracks it for Debug/LastCurl.
+func (c *Client) doDownloadRequest(ctx context.Context, reqPath string, offset int64) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.server+reqPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add(xsrfTokenKey, c.token)
+	if offset > 0 {
+		req.Header.Add("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	c.trackRequest(req, "GET", c.server+reqPath, "", nil)
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if c.Debug {
+		c.dumpResponse(resp)
+	}
+	return resp, nil
+}
+
+// resetFile truncates f and seeks it back to the start, discarding whatever was written so far.
+func resetFile(f *os.File) error {
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	_, err := f.Seek(0, io.SeekStart)
+	return err
+}
+
+// resumeRangeMatches reports whether a 206 response's Content-Range start matches offset, the
+// point we asked the server to resume from. A mismatch means the bytes already on disk don't
+// line up with what the server is about to send.
+func resumeRangeMatches(resp *http.Response, offset int64) bool {
+	cr := resp.Header.Get("Content-Range")
+	if cr == "" {
+		return true
+	}
+	cr = strings.TrimPrefix(cr, "bytes ")
+	parts := strings.SplitN(cr, "-", 2)
+	if len(parts) != 2 {
+		return true
+	}
+	start, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return true
+	}
+	return start == offset
+}
+
+// asDownloadError narrows a 403/404/410 APIError into a *DownloadError so callers can
+// distinguish an expired token from an exhausted or unknown one; any other status is returned
+// unchanged.
+func asDownloadError(apiErr *APIError) error {
+	switch apiErr.StatusCode {
+	case http.StatusForbidden, http.StatusNotFound, http.StatusGone:
+		return &DownloadError{apiErr}
+	default:
+		return apiErr
+	}
+}
+
+// hashFile computes the hex-encoded SHA256 of the file at path.
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hasher := sha256.New()
+	if _, err = io.Copy(hasher, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// compareChecksum fails if expected is non-empty and does not match actual, both hex-encoded.
+func compareChecksum(expected, actual string) error {
+	if expected == "" {
+		return nil
+	}
+	if !strings.EqualFold(expected, actual) {
+		return fmt.Errorf("checksum mismatch: expected %s, got %s", expected, actual)
+	}
+	return nil
+}
+
+// redactedKeys are JSON object keys whose values are masked before a request body is logged or
+// printed as curl.
+var redactedKeys = []string{"password"}
+
+// redactBody masks sensitive fields of a JSON request body for logging/curl output. Non-JSON
+// bodies (e.g. multipart uploads, which the caller suppresses entirely before this is reached)
+// are returned unchanged.
+func redactBody(contentType string, body []byte) []byte {
+	if !strings.Contains(contentType, "application/json") || len(body) == 0 {
+		return body
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(body, &m); err != nil {
+		return body
+	}
+	for k := range m {
+		for _, redacted := range redactedKeys {
+			if strings.EqualFold(k, redacted) {
+				m[k] = "***REDACTED***"
+			}
+		}
+	}
+	redacted, err := json.Marshal(m)
+	if err != nil {
+		return body
+	}
+	return redacted
+}
+
+// redactHeader masks the XSRF token and any cookies - request-side Cookie, response-side
+// Set-Cookie - on a cloned header set before it is logged or printed as curl.
+func redactHeader(h http.Header) {
+	if h.Get(xsrfTokenKey) != "" {
+		h.Set(xsrfTokenKey, "***REDACTED***")
+	}
+	if h.Get("Cookie") != "" {
+		h.Set("Cookie", "***REDACTED***")
+	}
+	if cookies := h["Set-Cookie"]; len(cookies) > 0 {
+		redacted := make([]string, len(cookies))
+		for i := range cookies {
+			redacted[i] = "***REDACTED***"
+		}
+		h["Set-Cookie"] = redacted
+	}
+}
+
+// isMultipart reports whether contentType is a multipart/form-data upload, whose body is never
+// logged to avoid spewing megabytes of binary data.
+func isMultipart(contentType string) bool {
+	return strings.HasPrefix(contentType, "multipart/form-data")
+}
+
+// trackRequest records req as the most recent request issued by the Client (for LastCurl) and,
+// when Debug is on, dumps it to the logger. Every request builder - reqCtx, uploadOnce,
+// DownloadContext and DownloadToFileContext - funnels through here so Debug/LastCurl cover the
+// whole API, not just the JSON calls.
+func (c *Client) trackRequest(req *http.Request, method, url, contentType string, body []byte) {
+	c.last = &lastRequest{method: method, url: url, header: req.Header.Clone(), contentType: contentType, body: body}
+	if c.Debug {
+		c.dumpRequest(req.Header, method, url, contentType, body)
+	}
+}
+
+// dumpRequest writes the outgoing request to the Debug logger. It builds a throwaway request
+// rather than dumping req directly, because httputil.DumpRequestOut drains the body it's given -
+// reusing req here would leave nothing left for c.Do to actually send.
+func (c *Client) dumpRequest(header http.Header, method, url, contentType string, body []byte) {
+	suppressed := isMultipart(contentType)
+	var bodyReader io.Reader
+	if !suppressed && len(body) > 0 {
+		bodyReader = bytes.NewReader(redactBody(contentType, body))
+	}
+	dumpReq, err := http.NewRequest(method, url, bodyReader)
+	if err != nil {
+		return
+	}
+	dumpReq.Header = header.Clone()
+	redactHeader(dumpReq.Header)
+	dump, err := httputil.DumpRequestOut(dumpReq, bodyReader != nil)
+	if err != nil {
+		return
+	}
+	if suppressed {
+		dump = append(dump, []byte("\n<multipart/form-data body suppressed>\n")...)
+	}
+	fmt.Fprintf(c.debugWriter(), "%s\n", dump)
+}
+
+// dumpResponse writes an incoming response to the Debug logger. Unlike DumpRequestOut,
+// DumpResponse restores resp.Body after reading it, so it's safe to call on the real response.
+func (c *Client) dumpResponse(resp *http.Response) {
+	original := resp.Header
+	redacted := original.Clone()
+	redactHeader(redacted)
+	resp.Header = redacted
+	dump, err := httputil.DumpResponse(resp, !isMultipart(original.Get("Content-type")))
+	resp.Header = original
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(c.debugWriter(), "%s\n", dump)
+}
+
+// debugWriter returns the logger set via SetLogger, defaulting to os.Stderr.
+func (c *Client) debugWriter() io.Writer {
+	if c.logger != nil {
+		return c.logger
+	}
+	return os.Stderr
+}
+
+// LastCurl renders the most recent request issued by this Client as a copy-pasteable curl
+// command, with the XSRF token, cookies and any password field redacted - handy for attaching to
+// bug reports without also leaking credentials.
+func (c *Client) LastCurl() string {
+	if c.last == nil {
+		return ""
+	}
+	header := c.last.header.Clone()
+	redactHeader(header)
+	parts := []string{"curl", "-X", shellQuote(c.last.method)}
+	keys := make([]string, 0, len(header))
+	for k := range header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		parts = append(parts, "-H", shellQuote(fmt.Sprintf("%s: %s", k, header.Get(k))))
+	}
+	if len(c.last.body) > 0 && !isMultipart(c.last.contentType) {
+		parts = append(parts, "-d", shellQuote(string(redactBody(c.last.contentType, c.last.body))))
+	}
+	parts = append(parts, shellQuote(c.last.url))
+	return strings.Join(parts, " ")
+}
+
+// shellQuote single-quotes s for safe inclusion in a POSIX shell command line.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}